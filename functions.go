@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// matchesCapability reports whether a job with the given function name may
+// be dispatched to a worker advertising the given capabilities, given how
+// many of each function have already been picked for this Lease call.
+// An empty functions map means the worker is a plain, untagged worker: it
+// only accepts jobs with no Function set. functions[name] is how many more
+// jobs of that function the worker can currently accept (see freeSlots); a
+// function that is absent from the map, or present with 0 free slots (one
+// that is currently saturated), is not eligible at all.
+func matchesCapability(function string, functions map[string]int, dispatched map[string]int) bool {
+	if len(functions) == 0 {
+		return function == ""
+	}
+	limit, ok := functions[function]
+	if !ok {
+		return false
+	}
+	return dispatched[function] < limit
+}
+
+// encodeFunctionSlots renders a worker's advertised capabilities as the wire
+// format used by the "functions" query parameter: comma-separated
+// "name:freeSlots" pairs, e.g. "resize:2,backup:3". A saturated function is
+// encoded as "name:0", which matchesCapability treats as not eligible; the
+// worker still counts as a function worker, so it is not handed plain jobs.
+func encodeFunctionSlots(slots map[string]int) string {
+	parts := make([]string, 0, len(slots))
+	for name, free := range slots {
+		parts = append(parts, fmt.Sprintf("%s:%d", name, free))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseFunctionSlots parses the "functions" query parameter produced by
+// encodeFunctionSlots back into a name -> free-slots map.
+func parseFunctionSlots(s string) (map[string]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	slots := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameSlots := strings.SplitN(part, ":", 2)
+		free := 0
+		if len(nameSlots) == 2 {
+			n, err := strconv.Atoi(nameSlots[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid slot count in %q: %w", part, err)
+			}
+			free = n
+		}
+		slots[nameSlots[0]] = free
+	}
+	return slots, nil
+}
+
+//
+// Worker-side in-process function handlers
+//
+
+// FuncHandler is an in-process job handler registered via RegisterFunc. It
+// receives the job's Command field as payload and returns the result that
+// gets captured as the job's output.
+type FuncHandler func(ctx context.Context, payload []byte) ([]byte, error)
+
+// funcRegistration is what's stored for a function registered with
+// RegisterFunc: the handler itself plus an optional dedicated concurrency
+// semaphore.
+type funcRegistration struct {
+	handler FuncHandler
+	sem     chan struct{} // nil means unlimited (bounded only by worker slots)
+}
+
+var (
+	funcRegistryMu sync.Mutex
+	funcRegistry   = map[string]*funcRegistration{}
+)
+
+// RegisterFunc registers an in-process handler for jobs whose Function field
+// is name, analogous to gearman-go's AddFunc. concurrency bounds how many
+// jobs of this function may run at once; 0 means no dedicated limit beyond
+// the worker's overall -slots count. Call it before runWorker.
+func RegisterFunc(name string, handler FuncHandler, concurrency int) {
+	funcRegistryMu.Lock()
+	defer funcRegistryMu.Unlock()
+	reg := &funcRegistration{handler: handler}
+	if concurrency > 0 {
+		reg.sem = make(chan struct{}, concurrency)
+	}
+	funcRegistry[name] = reg
+}
+
+// lookupFunc returns the handler registered for name, if any.
+func lookupFunc(name string) *funcRegistration {
+	if name == "" {
+		return nil
+	}
+	funcRegistryMu.Lock()
+	defer funcRegistryMu.Unlock()
+	return funcRegistry[name]
+}
+
+//
+// Worker-side capability advertisement
+//
+
+// funcCapability is one entry parsed from the -functions flag: a function
+// name this worker can execute, and how many may run at once (0 = no
+// dedicated limit, bounded only by -slots).
+type funcCapability struct {
+	name    string
+	limit   int
+	running int32 // atomic count of jobs of this function currently running
+}
+
+// parseFunctionFlag parses "-functions" values like
+// "toUpper:2,resize,backup:5" into a list of capabilities.
+func parseFunctionFlag(s string) ([]*funcCapability, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var caps []*funcCapability
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameLimit := strings.SplitN(part, ":", 2)
+		limit := 0
+		if len(nameLimit) == 2 {
+			l, err := strconv.Atoi(nameLimit[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid concurrency limit in %q: %w", part, err)
+			}
+			limit = l
+		}
+		caps = append(caps, &funcCapability{name: nameLimit[0], limit: limit})
+	}
+	return caps, nil
+}
+
+// freeSlots computes how many jobs of this function may currently be
+// leased, bounded by both its own limit and the worker's overall free slots.
+func (c *funcCapability) freeSlots(globalFree int) int {
+	free := globalFree
+	if c.limit > 0 {
+		if limFree := c.limit - int(atomic.LoadInt32(&c.running)); limFree < free {
+			free = limFree
+		}
+	}
+	if free < 0 {
+		free = 0
+	}
+	return free
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
@@ -8,11 +9,16 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -31,57 +37,269 @@ func debugLog(format string, v ...interface{}) {
 	}
 }
 
+// JobStatus represents the lifecycle state of a job.
+type JobStatus string
+
+const (
+	StatusQueued    JobStatus = "queued"
+	StatusRunning   JobStatus = "running"
+	StatusSucceeded JobStatus = "succeeded"
+	StatusFailed    JobStatus = "failed"
+	StatusTimeout   JobStatus = "timeout"
+	StatusDead      JobStatus = "dead" // retries exhausted, moved to the dead-letter queue
+)
+
+// Default retry policy applied to jobs that don't specify their own.
+const (
+	defaultMaxAttempts    = 3
+	defaultBackoffInitial = 1  // seconds
+	defaultBackoffMax     = 30 // seconds
+	defaultBackoffFactor  = 2.0
+)
+
+// Priority controls how urgently a job is dispatched relative to others
+// waiting in the same queue. It mirrors gearman-go's JOB_LOW/JOB_NORMAL/
+// JOB_HIGH distinction.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// normalizePriority defaults an empty priority to normal, and rejects
+// anything else unrecognized.
+func normalizePriority(p Priority) (Priority, error) {
+	switch p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityHigh, PriorityNormal, PriorityLow:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid priority %q (want high, normal or low)", p)
+	}
+}
+
 // Job represents a job to be executed.
 type Job struct {
 	ID      int    `json:"id"`
 	Command string `json:"command"`
 	Timeout int    `json:"timeout"` // in seconds
+
+	// Function, if set, names a capability a worker must advertise via
+	// -functions to be handed this job; RegisterFunc alone does not
+	// advertise it. Workers with a
+	// registered in-process handler for it run that handler with Command as
+	// the payload; otherwise it still runs as a shell command like any
+	// other job.
+	Function string `json:"function,omitempty"`
+
+	// Priority affects lease order: high priority jobs are handed out
+	// before normal, which are handed out before low (see queue.go's
+	// fairnessBound for how low priority jobs are interleaved).
+	Priority Priority `json:"priority,omitempty"`
+
+	// Background, if true, makes jobsHandler's response body just the
+	// assigned ID rather than the full job, mirroring gearman-go's JOB_BG.
+	// jobsHandler responds as soon as the job is queued either way.
+	Background bool `json:"background,omitempty"`
+
+	Status    JobStatus  `json:"status"`
+	ExitCode  int        `json:"exit_code"`
+	WorkerID  string     `json:"worker_id,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+
+	// Retry policy. Applied when a job fails or times out.
+	MaxAttempts    int     `json:"max_attempts,omitempty"`
+	Attempt        int     `json:"attempt,omitempty"`
+	BackoffInitial int     `json:"backoff_initial,omitempty"` // seconds
+	BackoffMax     int     `json:"backoff_max,omitempty"`     // seconds
+	BackoffFactor  float64 `json:"backoff_factor,omitempty"`
+
+	// NextRunAt is set while a job is waiting out its backoff delay; it must
+	// not be leased again until this time has passed.
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+}
+
+// applyRetryDefaults fills in unset retry policy fields with the defaults.
+func applyRetryDefaults(j *Job) {
+	if j.MaxAttempts <= 0 {
+		j.MaxAttempts = defaultMaxAttempts
+	}
+	if j.BackoffInitial <= 0 {
+		j.BackoffInitial = defaultBackoffInitial
+	}
+	if j.BackoffMax <= 0 {
+		j.BackoffMax = defaultBackoffMax
+	}
+	if j.BackoffFactor <= 0 {
+		j.BackoffFactor = defaultBackoffFactor
+	}
 }
 
 //
 // Server implementation
 //
 
-// jobQueue holds jobs in memory.
-type jobQueue struct {
+// jobRecord tracks the lifecycle state, captured output, and bookkeeping of a
+// single job, independent of whether it is still sitting in the queue.
+type jobRecord struct {
 	sync.Mutex
-	queue  []*Job
-	nextID int // auto increment ID for jobs
+	job    Job
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+// jobStore keeps every job ever submitted, keyed by ID, so that status and
+// logs can be queried after the job has left the queue.
+type jobStore struct {
+	sync.RWMutex
+	jobs map[int]*jobRecord
 }
 
-func newJobQueue() *jobQueue {
-	return &jobQueue{
-		queue:  make([]*Job, 0),
-		nextID: 1,
+func newJobStore() *jobStore {
+	return &jobStore{
+		jobs: make(map[int]*jobRecord),
 	}
 }
 
-// addJob appends a new job to the queue.
-func (q *jobQueue) addJob(j *Job) {
-	q.Lock()
-	defer q.Unlock()
-	j.ID = q.nextID
-	q.nextID++
-	q.queue = append(q.queue, j)
-	debugLog("Job added to queue: %+v", j)
+// put registers a newly-queued job in the store.
+func (s *jobStore) put(j Job) {
+	s.Lock()
+	defer s.Unlock()
+	s.jobs[j.ID] = &jobRecord{job: j}
 }
 
-// getJobs pops up to n jobs from the queue.
-func (q *jobQueue) getJobs(n int) []*Job {
-	q.Lock()
-	defer q.Unlock()
-	if n > len(q.queue) {
-		n = len(q.queue)
+// get returns a copy of the job's current state.
+func (s *jobStore) get(id int) (Job, bool) {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return Job{}, false
 	}
-	jobs := q.queue[:n]
-	q.queue = q.queue[n:]
-	debugLog("Fetched %d job(s) from queue; %d remaining", n, len(q.queue))
-	return jobs
+	rec.Lock()
+	defer rec.Unlock()
+	return rec.job, true
+}
+
+// updateStatus records a status transition reported by a worker.
+func (s *jobStore) updateStatus(id int, status JobStatus, exitCode int, workerID string) bool {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return false
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	now := time.Now()
+	rec.job.Status = status
+	rec.job.WorkerID = workerID
+	switch status {
+	case StatusRunning:
+		rec.job.StartedAt = &now
+	case StatusSucceeded, StatusFailed, StatusTimeout:
+		rec.job.ExitCode = exitCode
+		rec.job.EndedAt = &now
+	}
+	debugLog("Job %d: status updated to %s (worker=%s, exit=%d)", id, status, workerID, exitCode)
+	return true
+}
+
+// setAttempt records the attempt number a worker is about to run, as
+// assigned by the queue when the job was leased.
+func (s *jobStore) setAttempt(id int, attempt int) {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	rec.job.Attempt = attempt
+}
+
+// reschedule records that a job is waiting out its backoff delay before
+// being retried.
+func (s *jobStore) reschedule(id int, nextRunAt time.Time) {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	rec.job.Status = StatusQueued
+	rec.job.NextRunAt = &nextRunAt
+}
+
+// markDead records that a job exhausted its retries and moved to the
+// dead-letter queue.
+func (s *jobStore) markDead(id int) {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	rec.job.Status = StatusDead
+}
+
+// appendLog appends a chunk of captured output to the given stream ("stdout"
+// or "stderr") of a job.
+func (s *jobStore) appendLog(id int, stream string, chunk []byte) bool {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return false
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	switch stream {
+	case "stderr":
+		rec.stderr.Write(chunk)
+	default:
+		rec.stdout.Write(chunk)
+	}
+	return true
+}
+
+// logs returns the captured stdout and stderr for a job.
+func (s *jobStore) logs(id int) (stdout, stderr []byte, ok bool) {
+	s.RLock()
+	rec, ok := s.jobs[id]
+	s.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	rec.Lock()
+	defer rec.Unlock()
+	return append([]byte(nil), rec.stdout.Bytes()...), append([]byte(nil), rec.stderr.Bytes()...), true
 }
 
 var (
-	// globalQueue holds jobs in memory.
-	globalQueue = newJobQueue()
+	// globalQueue is the job queue backend in use; it is set up in runServer
+	// once the -queue flag has been parsed.
+	globalQueue Queue
+
+	// globalStore tracks lifecycle state and captured logs for every job.
+	globalStore = newJobStore()
+
+	// globalWorkers is the live registry of worker stats reported on /poll,
+	// exposed at GET /workers.
+	globalWorkers = newWorkerRegistry()
+
+	// defaultLeaseTTL bounds how long a worker can hold a leased job before
+	// it is made available to other workers again.
+	defaultLeaseTTL = 5 * time.Minute
 )
 
 // checkAuth verifies if the request has the correct password (if one is set).
@@ -113,10 +331,34 @@ func jobsHandler(w http.ResponseWriter, r *http.Request) {
 			debugLog("Missing command or invalid timeout in job: %+v", job)
 			return
 		}
-		globalQueue.addJob(&job)
+		priority, err := normalizePriority(job.Priority)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			debugLog("Invalid priority in job: %+v", job)
+			return
+		}
+		job.Priority = priority
+		job.Status = StatusQueued
+		applyRetryDefaults(&job)
+		if err := globalQueue.Add(&job); err != nil {
+			http.Error(w, "Error queuing job", http.StatusInternalServerError)
+			log.Printf("Error queuing job: %v\n", err)
+			return
+		}
+		globalStore.put(job)
 		log.Printf("Job added: %+v\n", job)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		if job.Background {
+			// Background jobs don't get a synchronous result; the caller
+			// only needs the ID to poll /jobs/{id} later.
+			if err := json.NewEncoder(w).Encode(struct {
+				ID int `json:"id"`
+			}{job.ID}); err != nil {
+				log.Printf("Error encoding response: %v", err)
+			}
+			return
+		}
 		if err := json.NewEncoder(w).Encode(job); err != nil {
 			log.Printf("Error encoding response: %v", err)
 		}
@@ -127,6 +369,144 @@ func jobsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// jobsSubHandler dispatches requests under /jobs/{id}, /jobs/{id}/status and
+// /jobs/{id}/logs. net/http's ServeMux has no path-variable support in this
+// Go version, so the sub-path is parsed by hand.
+func jobsSubHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		debugLog("Unauthorized request on %s", r.URL.Path)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		debugLog("Invalid job ID in path %s", r.URL.Path)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		jobStatusHandler(w, r, id)
+	case len(parts) == 2 && parts[1] == "status":
+		jobStatusUpdateHandler(w, r, id)
+	case len(parts) == 2 && parts[1] == "logs":
+		jobLogsHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// jobStatusHandler handles GET /jobs/{id}, returning the job's current state.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := globalStore.get(id)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		debugLog("Error encoding job %d: %v", id, err)
+	}
+}
+
+// jobStatusUpdate is the payload a worker POSTs to report a status transition.
+type jobStatusUpdate struct {
+	Status   JobStatus `json:"status"`
+	ExitCode int       `json:"exit_code"`
+	WorkerID string    `json:"worker_id"`
+}
+
+// jobStatusUpdateHandler handles POST /jobs/{id}/status, called by workers to
+// report lifecycle transitions.
+func jobStatusUpdateHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var update jobStatusUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		debugLog("Invalid status update payload for job %d: %v", id, err)
+		return
+	}
+	if !globalStore.updateStatus(id, update.Status, update.ExitCode, update.WorkerID) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	switch update.Status {
+	case StatusSucceeded:
+		if err := globalQueue.Ack(id); err != nil {
+			debugLog("Job %d: ack failed: %v", id, err)
+		}
+	case StatusFailed, StatusTimeout:
+		job, ok := globalStore.get(id)
+		if ok && job.Attempt < job.MaxAttempts {
+			nextRunAt := time.Now().Add(backoffDelay(job))
+			if err := globalQueue.Reschedule(id, nextRunAt); err != nil {
+				debugLog("Job %d: reschedule failed: %v", id, err)
+			} else {
+				globalStore.reschedule(id, nextRunAt)
+				log.Printf("Job %d: attempt %d/%d failed, retrying at %s\n", id, job.Attempt, job.MaxAttempts, nextRunAt.Format(time.RFC3339))
+			}
+		} else {
+			if err := globalQueue.DeadLetter(id); err != nil {
+				debugLog("Job %d: dead-letter failed: %v", id, err)
+			} else {
+				globalStore.markDead(id)
+				log.Printf("Job %d: exhausted %d attempt(s), moved to dead-letter queue\n", id, job.MaxAttempts)
+			}
+		}
+	}
+	log.Printf("Job %d status updated to %s by worker %s\n", id, update.Status, update.WorkerID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// jobLogsHandler handles GET and POST /jobs/{id}/logs: GET streams back the
+// captured output so far, POST appends a chunk reported by a worker. The
+// stream (stdout or stderr) is selected with the "stream" query parameter.
+func jobLogsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	stream := r.URL.Query().Get("stream")
+	switch r.Method {
+	case "GET":
+		stdout, stderr, ok := globalStore.logs(id)
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch stream {
+		case "stderr":
+			w.Write(stderr)
+		case "stdout":
+			w.Write(stdout)
+		default:
+			w.Write(stdout)
+			w.Write(stderr)
+		}
+	case "POST":
+		chunk, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading log chunk", http.StatusBadRequest)
+			return
+		}
+		if !globalStore.appendLog(id, stream, chunk) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func pollHandler(w http.ResponseWriter, r *http.Request) {
 	if !checkAuth(r) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -147,8 +527,30 @@ func pollHandler(w http.ResponseWriter, r *http.Request) {
 		debugLog("Invalid 'slots' parameter: %v", slotsStr)
 		return
 	}
-	debugLog("Polling for %d job(s)", slots)
-	jobs := globalQueue.getJobs(slots)
+	workerID := r.URL.Query().Get("worker")
+	if workerID == "" {
+		workerID = "unknown"
+	}
+	functions, err := parseFunctionSlots(r.URL.Query().Get("functions"))
+	if err != nil {
+		http.Error(w, "Invalid 'functions' parameter", http.StatusBadRequest)
+		debugLog("Invalid 'functions' parameter: %v", err)
+		return
+	}
+	stats := parseWorkerStats(r, workerID)
+	globalWorkers.report(stats)
+	admitted := admissionSlots(slots, stats)
+
+	debugLog("Polling for %d job(s) on behalf of worker %s (functions=%v, admitted=%d)", slots, workerID, functions, admitted)
+	jobs, err := globalQueue.Lease(admitted, workerID, defaultLeaseTTL, functions)
+	if err != nil {
+		http.Error(w, "Error leasing jobs", http.StatusInternalServerError)
+		debugLog("Error leasing jobs: %v", err)
+		return
+	}
+	for _, j := range jobs {
+		globalStore.setAttempt(j.ID, j.Attempt)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(jobs); err != nil {
 		debugLog("Error encoding jobs response: %v", err)
@@ -160,32 +562,157 @@ func runServer() {
 	port := flag.Int("port", 8080, "port for the server")
 	pass := flag.String("password", "", "password for authenticating requests")
 	debugFlag := flag.Bool("debug", false, "enable debug logging")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight requests to finish on shutdown")
+	queueKind := flag.String("queue", "memory", "job queue backend: memory, bolt or sqlite")
+	queuePath := flag.String("queue-path", "", "path to the queue database file (required for bolt and sqlite)")
+	leaseTTL := flag.Duration("lease-ttl", defaultLeaseTTL, "how long a worker may hold a leased job before it is requeued")
+	recoverInterval := flag.Duration("recover-interval", 30*time.Second, "how often to requeue jobs whose lease expired")
+	maxLoad := flag.Float64("max-load", 0, "per-CPU 1-minute load average above which a worker is admission-controlled to zero new jobs on /poll (0 disables)")
 	flag.Parse()
 	debug = *debugFlag
 	authPassword = *pass
+	defaultLeaseTTL = *leaseTTL
+	maxLoadPerCPU = *maxLoad
 
 	if debug {
 		log.Printf("Debug mode enabled on server")
 	}
+
+	queue, err := newQueue(*queueKind, *queuePath)
+	if err != nil {
+		log.Fatalf("Error setting up %s queue: %v", *queueKind, err)
+	}
+	globalQueue = queue
+	log.Printf("Using %s queue backend\n", *queueKind)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/", jobsSubHandler)
 	mux.HandleFunc("/poll", pollHandler)
+	mux.HandleFunc("/dead", deadHandler)
+	mux.HandleFunc("/workers", workersHandler)
 
 	addr := fmt.Sprintf(":%d", *port)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	recoverDone := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*recoverInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := globalQueue.Recover(); err != nil {
+					log.Printf("Error recovering expired leases: %v\n", err)
+				}
+			case <-recoverDone:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal %v, shutting down server (timeout=%s)...\n", sig, *shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error during server shutdown: %v\n", err)
+		}
+	}()
+
 	log.Printf("Server starting on %s...\n", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	close(recoverDone)
+	log.Printf("Server stopped")
 }
 
 //
 // Worker implementation
 //
 
-// jobRunner executes a job with the given command and timeout.
-func jobRunner(job *Job) {
+// workerContext bundles the information a worker needs to report job
+// lifecycle transitions and captured output back to the server.
+type workerContext struct {
+	client    *http.Client
+	serverURL string
+	password  string
+	workerID  string
+}
+
+// reportStatus POSTs a lifecycle transition for a job to the server.
+func (wc workerContext) reportStatus(jobID int, status JobStatus, exitCode int) {
+	update := jobStatusUpdate{Status: status, ExitCode: exitCode, WorkerID: wc.workerID}
+	body, err := json.Marshal(update)
+	if err != nil {
+		debugLog("Job %d: error encoding status update: %v", jobID, err)
+		return
+	}
+	url := fmt.Sprintf("%s/jobs/%d/status", wc.serverURL, jobID)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		debugLog("Job %d: error creating status update request: %v", jobID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wc.password != "" {
+		req.Header.Set("X-Job-Password", wc.password)
+	}
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		log.Printf("Job %d: error reporting status %s: %v\n", jobID, status, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// remoteLogWriter tees a job's captured output to the local stream (stdout or
+// stderr) and streams each chunk to the server as it is produced.
+type remoteLogWriter struct {
+	wc     workerContext
+	jobID  int
+	stream string // "stdout" or "stderr"
+	local  io.Writer
+}
+
+func (w *remoteLogWriter) Write(p []byte) (int, error) {
+	w.local.Write(p)
+	url := fmt.Sprintf("%s/jobs/%d/logs?stream=%s", w.wc.serverURL, w.jobID, w.stream)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(p))
+	if err != nil {
+		debugLog("Job %d: error creating log chunk request: %v", w.jobID, err)
+		return len(p), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if w.wc.password != "" {
+		req.Header.Set("X-Job-Password", w.wc.password)
+	}
+	resp, err := w.wc.client.Do(req)
+	if err != nil {
+		debugLog("Job %d: error streaming %s chunk: %v", w.jobID, w.stream, err)
+		return len(p), nil
+	}
+	resp.Body.Close()
+	return len(p), nil
+}
+
+// jobRunner executes a job with the given command and timeout, reporting
+// status transitions and captured output back to the server as it goes. If
+// job.Function has an in-process handler registered via RegisterFunc, it runs
+// that instead of shelling out.
+func jobRunner(job *Job, wc workerContext) {
+	if reg := lookupFunc(job.Function); reg != nil {
+		runFunctionJob(job, wc, reg)
+		return
+	}
 	log.Printf("Starting job %d: %s (timeout=%ds)\n", job.ID, job.Command, job.Timeout)
 	debugLog("Job %d: setting up context with %ds timeout", job.ID, job.Timeout)
+	wc.reportStatus(job.ID, StatusRunning, 0)
 
 	// Create a context with timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(job.Timeout)*time.Second)
@@ -195,23 +722,69 @@ func jobRunner(job *Job) {
 	cmd := exec.CommandContext(ctx, "nice", "-n", "19", "sh", "-c", job.Command)
 	debugLog("Job %d: command prepared: %v", job.ID, cmd.Args)
 
-	// Redirect output.
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Redirect output, capturing it for the server as well as printing locally.
+	cmd.Stdout = &remoteLogWriter{wc: wc, jobID: job.ID, stream: "stdout", local: os.Stdout}
+	cmd.Stderr = &remoteLogWriter{wc: wc, jobID: job.ID, stream: "stderr", local: os.Stderr}
 
 	err := cmd.Run()
+	exitCode := 0
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			log.Printf("Job %d timed out\n", job.ID)
 			debugLog("Job %d context deadline exceeded", job.ID)
+			wc.reportStatus(job.ID, StatusTimeout, -1)
+			return
+		}
+		log.Printf("Job %d finished with error: %v\n", job.ID, err)
+		debugLog("Job %d error details: %v", job.ID, err)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
 		} else {
-			log.Printf("Job %d finished with error: %v\n", job.ID, err)
-			debugLog("Job %d error details: %v", job.ID, err)
+			exitCode = -1
+		}
+		wc.reportStatus(job.ID, StatusFailed, exitCode)
+		return
+	}
+	log.Printf("Job %d finished successfully\n", job.ID)
+	debugLog("Job %d finished without error", job.ID)
+	wc.reportStatus(job.ID, StatusSucceeded, cmd.ProcessState.ExitCode())
+}
+
+// runFunctionJob executes a job via its in-process handler reg instead of
+// "sh -c", reporting the same status transitions and captured output as
+// jobRunner. job.Command is passed to the handler as its payload, and
+// whatever it returns is written to the job's stdout log.
+func runFunctionJob(job *Job, wc workerContext, reg *funcRegistration) {
+	log.Printf("Starting job %d: function %s (timeout=%ds)\n", job.ID, job.Function, job.Timeout)
+	wc.reportStatus(job.ID, StatusRunning, 0)
+
+	if reg.sem != nil {
+		reg.sem <- struct{}{}
+		defer func() { <-reg.sem }()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(job.Timeout)*time.Second)
+	defer cancel()
+
+	stdout := &remoteLogWriter{wc: wc, jobID: job.ID, stream: "stdout", local: os.Stdout}
+	stderr := &remoteLogWriter{wc: wc, jobID: job.ID, stream: "stderr", local: os.Stderr}
+
+	result, err := reg.handler(ctx, []byte(job.Command))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Job %d timed out\n", job.ID)
+			debugLog("Job %d context deadline exceeded", job.ID)
+			wc.reportStatus(job.ID, StatusTimeout, -1)
+			return
 		}
-	} else {
-		log.Printf("Job %d finished successfully\n", job.ID)
-		debugLog("Job %d finished without error", job.ID)
+		log.Printf("Job %d finished with error: %v\n", job.ID, err)
+		fmt.Fprintln(stderr, err)
+		wc.reportStatus(job.ID, StatusFailed, -1)
+		return
 	}
+	stdout.Write(result)
+	log.Printf("Job %d finished successfully\n", job.ID)
+	wc.reportStatus(job.ID, StatusSucceeded, 0)
 }
 
 func runWorker() {
@@ -221,14 +794,33 @@ func runWorker() {
 	pollInt := flag.Int("poll", 1, "poll interval in seconds")
 	pass := flag.String("password", "", "password for authenticating with the server")
 	debugFlag := flag.Bool("debug", false, "enable debug logging")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for running jobs to finish on shutdown")
+	functionsFlag := flag.String("functions", "", "comma-separated functions this worker accepts, e.g. toUpper:2,resize,backup:5 (omit to accept any plain job)")
 	flag.Parse()
 	debug = *debugFlag
 
+	capabilities, err := parseFunctionFlag(*functionsFlag)
+	if err != nil {
+		log.Fatalf("Invalid -functions flag: %v", err)
+	}
+	capabilityByName := make(map[string]*funcCapability, len(capabilities))
+	for _, c := range capabilities {
+		capabilityByName[c.name] = c
+	}
+
 	log.Printf("Worker starting with %d slots (server: %s)\n", *slots, *serverURL)
-	debugLog("Worker flags: slots=%d, poll interval=%ds", *slots, *pollInt)
+	debugLog("Worker flags: slots=%d, poll interval=%ds, functions=%s", *slots, *pollInt, *functionsFlag)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	workerID := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	debugLog("Worker ID: %s", workerID)
 
 	// Semaphore channel to limit concurrency.
 	sem := make(chan struct{}, *slots)
+	var running sync.WaitGroup
 
 	// getFreeSlots returns the number of free job slots.
 	getFreeSlots := func() int {
@@ -237,11 +829,46 @@ func runWorker() {
 		return free
 	}
 
+	// functionSlots returns this worker's advertised capabilities and how
+	// many jobs of each it can currently accept, for the "functions" poll
+	// parameter. Empty (and omitted from the poll URL) for plain workers.
+	// A capability that is currently saturated is advertised as "name:0", so
+	// the server's matchesCapability treats it as not eligible right now
+	// without mistaking this worker for a plain one.
+	functionSlots := func() string {
+		if len(capabilities) == 0 {
+			return ""
+		}
+		globalFree := getFreeSlots()
+		slots := make(map[string]int, len(capabilities))
+		for _, c := range capabilities {
+			slots[c.name] = c.freeSlots(globalFree)
+		}
+		return encodeFunctionSlots(slots)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	stopping := false
+
 	client := &http.Client{}
-	for {
+	wc := workerContext{client: client, serverURL: *serverURL, password: *pass, workerID: workerID}
+	for !stopping {
+		select {
+		case sig := <-sigCh:
+			log.Printf("Received signal %v, draining in-flight jobs before exiting...\n", sig)
+			stopping = true
+			continue
+		default:
+		}
+
 		freeSlots := getFreeSlots()
 		if freeSlots > 0 {
-			pollURL := fmt.Sprintf("%s/poll?slots=%d", *serverURL, freeSlots)
+			pollURL := fmt.Sprintf("%s/poll?slots=%d&worker=%s", *serverURL, freeSlots, workerID)
+			if fs := functionSlots(); fs != "" {
+				pollURL += "&functions=" + url.QueryEscape(fs)
+			}
+			pollURL += "&" + hostStatsQuery(hostname, *slots-freeSlots).Encode()
 			debugLog("Polling URL: %s", pollURL)
 
 			// Create a new request so we can add a header.
@@ -267,20 +894,47 @@ func runWorker() {
 					debugLog("Received %d job(s) from server", len(jobs))
 					for _, job := range jobs {
 						sem <- struct{}{}
-						go func(j *Job) {
+						running.Add(1)
+						fc := capabilityByName[job.Function]
+						if fc != nil {
+							atomic.AddInt32(&fc.running, 1)
+						}
+						go func(j *Job, fc *funcCapability) {
 							defer func() {
 								<-sem
+								running.Done()
+								if fc != nil {
+									atomic.AddInt32(&fc.running, -1)
+								}
 								debugLog("Job %d: slot freed", j.ID)
 							}()
 							debugLog("Job %d: starting execution", j.ID)
-							jobRunner(j)
-						}(job)
+							jobRunner(j, wc)
+						}(job, fc)
 					}
 				}
 				resp.Body.Close()
 			}
 		}
-		time.Sleep(time.Duration(*pollInt) * time.Second)
+
+		select {
+		case sig := <-sigCh:
+			log.Printf("Received signal %v, draining in-flight jobs before exiting...\n", sig)
+			stopping = true
+		case <-time.After(time.Duration(*pollInt) * time.Second):
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Printf("All in-flight jobs finished, exiting")
+	case <-time.After(*shutdownTimeout):
+		log.Printf("Shutdown timeout (%s) reached with jobs still running, exiting anyway", *shutdownTimeout)
 	}
 }
 
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queue is implemented by every job queue backend. A backend is responsible
+// for durably storing jobs and handing them out to workers under a lease, so
+// that a worker crash does not lose the job: if the lease expires before the
+// worker Acks it (or the server Reschedules or DeadLetters it on failure),
+// Recover makes it available again.
+type Queue interface {
+	// Add stores a new job, assigning it an ID.
+	Add(j *Job) error
+	// Lease hands out up to n due jobs that are not currently leased,
+	// marking them leased to workerID until leaseTTL elapses. Jobs are
+	// handed out in priority order (see orderByPriority). If functions is
+	// non-empty, only jobs whose Function is a key in it are eligible, and
+	// at most functions[name] of each are handed out; a worker that
+	// advertises no functions is only handed jobs with no Function set.
+	Lease(n int, workerID string, leaseTTL time.Duration, functions map[string]int) ([]*Job, error)
+	// Ack marks a leased job as done, removing it from the queue.
+	Ack(id int) error
+	// Reschedule releases a leased job's lease and hides it from Lease
+	// until nextRunAt, used to apply a retry's backoff delay.
+	Reschedule(id int, nextRunAt time.Time) error
+	// DeadLetter moves a leased job out of the active queue and into the
+	// dead-letter queue, for jobs that exhausted their retries.
+	DeadLetter(id int) error
+	// DeadLetters returns the jobs currently in the dead-letter queue.
+	DeadLetters() ([]*Job, error)
+	// Recover requeues jobs whose lease has expired. It is meant to be
+	// polled periodically from a background goroutine.
+	Recover() error
+}
+
+// newQueue builds the Queue backend selected by kind ("memory", "bolt" or
+// "sqlite"). path is ignored for the in-memory backend.
+func newQueue(kind, path string) (Queue, error) {
+	switch kind {
+	case "", "memory":
+		return newMemoryQueue(), nil
+	case "bolt":
+		if path == "" {
+			return nil, fmt.Errorf("-queue-path is required for the bolt queue backend")
+		}
+		return newBoltQueue(path)
+	case "sqlite":
+		if path == "" {
+			return nil, fmt.Errorf("-queue-path is required for the sqlite queue backend")
+		}
+		return newSQLiteQueue(path)
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q (want memory, bolt or sqlite)", kind)
+	}
+}
+
+// fairnessBound caps how many jobs orderByPriority places from the
+// high/normal buckets in a row before a pending low priority job is forced
+// in. The count starts afresh on every call, so it bounds the order within
+// a single Lease call only: while each Lease takes at most fairnessBound
+// jobs and at least that many higher-priority jobs are waiting, low
+// priority jobs are not leased.
+const fairnessBound = 5
+
+// orderByPriority reorders candidates, a list of jobs already in FIFO
+// (submission) order, into lease order: high priority first, then normal,
+// then low, while keeping each priority's own relative order intact. Every
+// fairnessBound jobs taken from high/normal without one coming from low, the
+// next available low priority job is forced in instead.
+func orderByPriority(candidates []*Job) []*Job {
+	var high, normal, low []*Job
+	for _, j := range candidates {
+		switch j.Priority {
+		case PriorityHigh:
+			high = append(high, j)
+		case PriorityLow:
+			low = append(low, j)
+		default:
+			normal = append(normal, j)
+		}
+	}
+	out := make([]*Job, 0, len(candidates))
+	hi, ni, li, streak := 0, 0, 0, 0
+	for hi < len(high) || ni < len(normal) || li < len(low) {
+		if streak >= fairnessBound && li < len(low) {
+			out = append(out, low[li])
+			li++
+			streak = 0
+			continue
+		}
+		switch {
+		case hi < len(high):
+			out = append(out, high[hi])
+			hi++
+			streak++
+		case ni < len(normal):
+			out = append(out, normal[ni])
+			ni++
+			streak++
+		default:
+			out = append(out, low[li])
+			li++
+			streak = 0
+		}
+	}
+	return out
+}
+
+// leasedJob tracks who currently holds a job's lease and when it expires.
+type leasedJob struct {
+	job      *Job
+	workerID string
+	expires  time.Time
+}
+
+// memoryQueue is the in-memory Queue backend. It does not survive a restart.
+type memoryQueue struct {
+	sync.Mutex
+	queue  []*Job
+	leased map[int]*leasedJob
+	dead   []*Job
+	nextID int // auto increment ID for jobs
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{
+		queue:  make([]*Job, 0),
+		leased: make(map[int]*leasedJob),
+		nextID: 1,
+	}
+}
+
+// Add appends a new job to the queue.
+func (q *memoryQueue) Add(j *Job) error {
+	q.Lock()
+	defer q.Unlock()
+	j.ID = q.nextID
+	q.nextID++
+	q.queue = append(q.queue, j)
+	debugLog("Job added to queue: %+v", j)
+	return nil
+}
+
+// Lease picks up to n jobs that are due (NextRunAt, if set, has passed) and
+// match the worker's advertised functions, in priority order (see
+// orderByPriority), and marks them leased, preserving the order of the ones
+// left behind.
+func (q *memoryQueue) Lease(n int, workerID string, leaseTTL time.Duration, functions map[string]int) ([]*Job, error) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	expires := now.Add(leaseTTL)
+	dispatched := map[string]int{}
+	picked := make(map[int]bool)
+	var jobs []*Job
+	for _, j := range orderByPriority(q.queue) {
+		if len(jobs) >= n {
+			break
+		}
+		if j.NextRunAt != nil && j.NextRunAt.After(now) {
+			continue
+		}
+		if !matchesCapability(j.Function, functions, dispatched) {
+			continue
+		}
+		j.Attempt++
+		j.NextRunAt = nil
+		q.leased[j.ID] = &leasedJob{job: j, workerID: workerID, expires: expires}
+		jobs = append(jobs, j)
+		dispatched[j.Function]++
+		picked[j.ID] = true
+	}
+	if len(picked) > 0 {
+		remaining := q.queue[:0]
+		for _, j := range q.queue {
+			if !picked[j.ID] {
+				remaining = append(remaining, j)
+			}
+		}
+		q.queue = remaining
+	}
+	debugLog("Leased %d job(s) to worker %s; %d remaining queued", len(jobs), workerID, len(q.queue))
+	return jobs, nil
+}
+
+// Ack removes a leased job for good.
+func (q *memoryQueue) Ack(id int) error {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.leased[id]; !ok {
+		return fmt.Errorf("job %d not leased", id)
+	}
+	delete(q.leased, id)
+	debugLog("Job %d acked", id)
+	return nil
+}
+
+// Reschedule releases a leased job's lease and hides it until nextRunAt.
+func (q *memoryQueue) Reschedule(id int, nextRunAt time.Time) error {
+	q.Lock()
+	defer q.Unlock()
+	lj, ok := q.leased[id]
+	if !ok {
+		return fmt.Errorf("job %d not leased", id)
+	}
+	delete(q.leased, id)
+	lj.job.NextRunAt = &nextRunAt
+	q.queue = append(q.queue, lj.job)
+	debugLog("Job %d: rescheduled for %s after backoff", id, nextRunAt.Format(time.RFC3339))
+	return nil
+}
+
+// DeadLetter moves a leased job into the dead-letter queue.
+func (q *memoryQueue) DeadLetter(id int) error {
+	q.Lock()
+	defer q.Unlock()
+	lj, ok := q.leased[id]
+	if !ok {
+		return fmt.Errorf("job %d not leased", id)
+	}
+	delete(q.leased, id)
+	q.dead = append(q.dead, lj.job)
+	debugLog("Job %d: moved to dead-letter queue", id)
+	return nil
+}
+
+// DeadLetters returns a copy of the dead-letter queue.
+func (q *memoryQueue) DeadLetters() ([]*Job, error) {
+	q.Lock()
+	defer q.Unlock()
+	out := make([]*Job, len(q.dead))
+	copy(out, q.dead)
+	return out, nil
+}
+
+// Recover requeues jobs whose lease expired without being Acked.
+func (q *memoryQueue) Recover() error {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for id, lj := range q.leased {
+		if now.After(lj.expires) {
+			delete(q.leased, id)
+			q.queue = append(q.queue, lj.job)
+			debugLog("Job %d: lease expired, requeued", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	boltJobsBucket   = []byte("jobs")
+	boltLeasesBucket = []byte("leases")
+	boltDeadBucket   = []byte("dead")
+)
+
+// boltLease records who holds a job's lease and when it expires.
+type boltLease struct {
+	WorkerID string    `json:"worker_id"`
+	Expires  time.Time `json:"expires"`
+}
+
+// boltQueue is a Queue backed by a BoltDB (bbolt) file, surviving worker and
+// server restarts.
+type boltQueue struct {
+	db *bbolt.DB
+}
+
+func newBoltQueue(path string) (*boltQueue, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt queue at %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltJobsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltLeasesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltDeadBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltQueue{db: db}, nil
+}
+
+func boltIDKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// Add stores a new job under an auto-incrementing bucket sequence.
+func (q *boltQueue) Add(j *Job) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltJobsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		j.ID = int(seq)
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		debugLog("Job added to bolt queue: %+v", j)
+		return bucket.Put(boltIDKey(j.ID), data)
+	})
+}
+
+// Lease scans jobs in ID order to find every due, unleased candidate that
+// matches the worker's advertised functions, then leases up to n of them in
+// priority order (see orderByPriority).
+func (q *boltQueue) Lease(n int, workerID string, leaseTTL time.Duration, functions map[string]int) ([]*Job, error) {
+	var jobs []*Job
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		jobsB := tx.Bucket(boltJobsBucket)
+		leasesB := tx.Bucket(boltLeasesBucket)
+		now := time.Now()
+		expires := now.Add(leaseTTL)
+
+		var candidates []*Job
+		keys := map[int][]byte{}
+		c := jobsB.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if leasesB.Get(k) != nil {
+				continue // already leased
+			}
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if j.NextRunAt != nil && j.NextRunAt.After(now) {
+				continue // still waiting out its backoff delay
+			}
+			candidates = append(candidates, &j)
+			keys[j.ID] = append([]byte(nil), k...)
+		}
+
+		dispatched := map[string]int{}
+		for _, j := range orderByPriority(candidates) {
+			if len(jobs) >= n {
+				break
+			}
+			if !matchesCapability(j.Function, functions, dispatched) {
+				continue
+			}
+			dispatched[j.Function]++
+			j.Attempt++
+			j.NextRunAt = nil
+			data, err := json.Marshal(j)
+			if err != nil {
+				return err
+			}
+			k := keys[j.ID]
+			if err := jobsB.Put(k, data); err != nil {
+				return err
+			}
+			lease, err := json.Marshal(boltLease{WorkerID: workerID, Expires: expires})
+			if err != nil {
+				return err
+			}
+			if err := leasesB.Put(k, lease); err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	debugLog("Leased %d job(s) from bolt queue to worker %s", len(jobs), workerID)
+	return jobs, nil
+}
+
+// Ack deletes a job and its lease for good.
+func (q *boltQueue) Ack(id int) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		key := boltIDKey(id)
+		jobsB := tx.Bucket(boltJobsBucket)
+		if jobsB.Get(key) == nil {
+			return fmt.Errorf("job %d not found", id)
+		}
+		if err := jobsB.Delete(key); err != nil {
+			return err
+		}
+		debugLog("Job %d acked (bolt)", id)
+		return tx.Bucket(boltLeasesBucket).Delete(key)
+	})
+}
+
+// Reschedule drops a job's lease and records the backoff delay on the job
+// itself, so Lease skips it until it elapses.
+func (q *boltQueue) Reschedule(id int, nextRunAt time.Time) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		key := boltIDKey(id)
+		jobsB := tx.Bucket(boltJobsBucket)
+		data := jobsB.Get(key)
+		if data == nil {
+			return fmt.Errorf("job %d not found", id)
+		}
+		var j Job
+		if err := json.Unmarshal(data, &j); err != nil {
+			return err
+		}
+		j.NextRunAt = &nextRunAt
+		updated, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		if err := jobsB.Put(key, updated); err != nil {
+			return err
+		}
+		debugLog("Job %d: rescheduled for %s after backoff (bolt)", id, nextRunAt.Format(time.RFC3339))
+		return tx.Bucket(boltLeasesBucket).Delete(key)
+	})
+}
+
+// DeadLetter moves a job from the active bucket into the dead-letter bucket.
+func (q *boltQueue) DeadLetter(id int) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		key := boltIDKey(id)
+		jobsB := tx.Bucket(boltJobsBucket)
+		data := jobsB.Get(key)
+		if data == nil {
+			return fmt.Errorf("job %d not found", id)
+		}
+		if err := tx.Bucket(boltDeadBucket).Put(key, data); err != nil {
+			return err
+		}
+		if err := jobsB.Delete(key); err != nil {
+			return err
+		}
+		debugLog("Job %d: moved to dead-letter queue (bolt)", id)
+		return tx.Bucket(boltLeasesBucket).Delete(key)
+	})
+}
+
+// DeadLetters returns every job currently in the dead-letter bucket.
+func (q *boltQueue) DeadLetters() ([]*Job, error) {
+	var jobs []*Job
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltDeadBucket).ForEach(func(k, v []byte) error {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			jobs = append(jobs, &j)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Recover drops leases that expired without an Ack.
+func (q *boltQueue) Recover() error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		leasesB := tx.Bucket(boltLeasesBucket)
+		now := time.Now()
+		var expired [][]byte
+		c := leasesB.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var lease boltLease
+			if err := json.Unmarshal(v, &lease); err != nil {
+				return err
+			}
+			if now.After(lease.Expires) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range expired {
+			debugLog("Job %d: lease expired, requeued (bolt)", int(binary.BigEndian.Uint64(k)))
+			if err := leasesB.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
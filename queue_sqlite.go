@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteQueue is a Queue backed by a SQLite database file, surviving worker
+// and server restarts. Each job is stored as a JSON blob so that the schema
+// does not need to change every time a field is added to Job; leased_until
+// and next_run_at are broken out into columns so Lease can filter on them in
+// SQL, and leased_by records which worker holds the lease.
+type sqliteQueue struct {
+	db *sql.DB
+}
+
+func newSQLiteQueue(path string) (*sqliteQueue, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite queue at %s: %w", path, err)
+	}
+	// The driver does not support concurrent writers, so serialize access.
+	db.SetMaxOpenConns(1)
+	schema := `
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	data TEXT NOT NULL,
+	leased_by TEXT,
+	leased_until DATETIME,
+	next_run_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS dead_jobs (
+	id INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+);`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sqlite schema: %w", err)
+	}
+	return &sqliteQueue{db: db}, nil
+}
+
+// Add inserts a new job row, letting SQLite assign the ID.
+func (q *sqliteQueue) Add(j *Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	res, err := q.db.Exec(`INSERT INTO jobs (data) VALUES (?)`, data)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	j.ID = int(id)
+	// The ID was only assigned after marshaling, so persist it too.
+	data, err = json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if _, err := q.db.Exec(`UPDATE jobs SET data = ? WHERE id = ?`, data, j.ID); err != nil {
+		return err
+	}
+	debugLog("Job added to sqlite queue: %+v", j)
+	return nil
+}
+
+// Lease selects up to n due jobs that are not currently leased and that
+// match the worker's advertised functions, in priority order (see
+// orderByPriority), and marks them leased to workerID.
+func (q *sqliteQueue) Lease(n int, workerID string, leaseTTL time.Duration, functions map[string]int) ([]*Job, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Function eligibility depends on how many of each function have
+	// already been picked, so candidates are filtered in Go rather than
+	// with a LIMIT in SQL.
+	now := time.Now()
+	rows, err := tx.Query(`
+SELECT id, data FROM jobs
+WHERE (leased_until IS NULL OR leased_until < ?)
+  AND (next_run_at IS NULL OR next_run_at <= ?)
+ORDER BY id`, now, now)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*Job
+	for rows.Next() {
+		var id int
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var j Job
+		if err := json.Unmarshal([]byte(data), &j); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, &j)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	dispatched := map[string]int{}
+	var jobs []*Job
+	for _, j := range orderByPriority(candidates) {
+		if len(jobs) >= n {
+			break
+		}
+		if !matchesCapability(j.Function, functions, dispatched) {
+			continue
+		}
+		dispatched[j.Function]++
+		jobs = append(jobs, j)
+	}
+
+	expires := now.Add(leaseTTL)
+	for _, j := range jobs {
+		j.Attempt++
+		j.NextRunAt = nil
+		data, err := json.Marshal(j)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`UPDATE jobs SET data = ?, leased_by = ?, leased_until = ?, next_run_at = NULL WHERE id = ?`, data, workerID, expires, j.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	debugLog("Leased %d job(s) from sqlite queue to worker %s", len(jobs), workerID)
+	return jobs, nil
+}
+
+// Ack deletes the job row for good.
+func (q *sqliteQueue) Ack(id int) error {
+	res, err := q.db.Exec(`DELETE FROM jobs WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("job %d not found", id)
+	}
+	debugLog("Job %d acked (sqlite)", id)
+	return nil
+}
+
+// Reschedule clears the job's lease and sets next_run_at so Lease skips it
+// until the backoff delay elapses.
+func (q *sqliteQueue) Reschedule(id int, nextRunAt time.Time) error {
+	var data string
+	if err := q.db.QueryRow(`SELECT data FROM jobs WHERE id = ?`, id).Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("job %d not found", id)
+		}
+		return err
+	}
+	var j Job
+	if err := json.Unmarshal([]byte(data), &j); err != nil {
+		return err
+	}
+	j.NextRunAt = &nextRunAt
+	updated, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if _, err := q.db.Exec(`UPDATE jobs SET data = ?, leased_by = NULL, leased_until = NULL, next_run_at = ? WHERE id = ?`, updated, nextRunAt, id); err != nil {
+		return err
+	}
+	debugLog("Job %d: rescheduled for %s after backoff (sqlite)", id, nextRunAt.Format(time.RFC3339))
+	return nil
+}
+
+// DeadLetter moves a job row from jobs into dead_jobs.
+func (q *sqliteQueue) DeadLetter(id int) error {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data string
+	if err := tx.QueryRow(`SELECT data FROM jobs WHERE id = ?`, id).Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("job %d not found", id)
+		}
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO dead_jobs (id, data) VALUES (?, ?)`, id, data); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM jobs WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	debugLog("Job %d: moved to dead-letter queue (sqlite)", id)
+	return nil
+}
+
+// DeadLetters returns every job currently in the dead_jobs table.
+func (q *sqliteQueue) DeadLetters() ([]*Job, error) {
+	rows, err := q.db.Query(`SELECT data FROM dead_jobs ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*Job
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var j Job
+		if err := json.Unmarshal([]byte(data), &j); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &j)
+	}
+	return jobs, rows.Err()
+}
+
+// Recover clears leases that expired without an Ack.
+func (q *sqliteQueue) Recover() error {
+	res, err := q.db.Exec(`UPDATE jobs SET leased_by = NULL, leased_until = NULL WHERE leased_until IS NOT NULL AND leased_until < ?`, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		debugLog("Recovered %d job(s) with expired lease (sqlite)", n)
+	}
+	return nil
+}
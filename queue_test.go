@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryQueueLeaseAckLifecycle(t *testing.T) {
+	q := newMemoryQueue()
+	job := &Job{Command: "echo hi", Timeout: 5}
+	if err := q.Add(job); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	leased, err := q.Lease(1, "worker-1", time.Minute, nil)
+	if err != nil || len(leased) != 1 || leased[0].ID != job.ID {
+		t.Fatalf("expected job %d leased, got %+v, err %v", job.ID, leased, err)
+	}
+	if again, err := q.Lease(1, "worker-2", time.Minute, nil); err != nil || len(again) != 0 {
+		t.Fatalf("expected no jobs available while leased, got %+v, err %v", again, err)
+	}
+
+	if err := q.Ack(job.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := q.Ack(job.ID); err == nil {
+		t.Fatal("expected Ack of an already-acked job to fail")
+	}
+}
+
+func TestMemoryQueueRecoverRequeuesExpiredLease(t *testing.T) {
+	q := newMemoryQueue()
+	job := &Job{Command: "echo hi", Timeout: 5}
+	q.Add(job)
+
+	// A negative TTL produces an already-expired lease.
+	if leased, err := q.Lease(1, "worker-1", -time.Second, nil); err != nil || len(leased) != 1 {
+		t.Fatalf("Lease: %+v, err %v", leased, err)
+	}
+
+	if err := q.Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	again, err := q.Lease(1, "worker-2", time.Minute, nil)
+	if err != nil || len(again) != 1 || again[0].ID != job.ID {
+		t.Fatalf("expected job requeued after Recover, got %+v, err %v", again, err)
+	}
+}
+
+func TestMemoryQueueRecoverLeavesUnexpiredLeaseAlone(t *testing.T) {
+	q := newMemoryQueue()
+	job := &Job{Command: "echo hi", Timeout: 5}
+	q.Add(job)
+	q.Lease(1, "worker-1", time.Minute, nil)
+
+	if err := q.Recover(); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	again, err := q.Lease(1, "worker-2", time.Minute, nil)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("expected still-leased job to stay leased, got %+v, err %v", again, err)
+	}
+}
+
+func TestOrderByPriorityKeepsEachBucketInFIFOOrder(t *testing.T) {
+	jobs := []*Job{
+		{ID: 1, Priority: PriorityNormal},
+		{ID: 2, Priority: PriorityHigh},
+		{ID: 3, Priority: PriorityNormal},
+		{ID: 4, Priority: PriorityHigh},
+	}
+	ordered := orderByPriority(jobs)
+	want := []int{2, 4, 1, 3}
+	for i, id := range want {
+		if ordered[i].ID != id {
+			t.Fatalf("position %d: want job %d, got %d (full order %v)", i, id, ordered[i].ID, idsOf(ordered))
+		}
+	}
+}
+
+func TestOrderByPriorityForcesInLowAfterFairnessBound(t *testing.T) {
+	var jobs []*Job
+	for i := 0; i < fairnessBound*2; i++ {
+		jobs = append(jobs, &Job{ID: i + 1, Priority: PriorityHigh})
+	}
+	const lowID = 1000
+	jobs = append(jobs, &Job{ID: lowID, Priority: PriorityLow})
+
+	ordered := orderByPriority(jobs)
+	if len(ordered) != len(jobs) {
+		t.Fatalf("expected %d jobs, got %d", len(jobs), len(ordered))
+	}
+	lowPos := -1
+	for i, j := range ordered {
+		if j.ID == lowID {
+			lowPos = i
+		}
+	}
+	if lowPos != fairnessBound {
+		t.Fatalf("expected the low priority job forced in at index %d, got %d (full order %v)", fairnessBound, lowPos, idsOf(ordered))
+	}
+}
+
+func idsOf(jobs []*Job) []int {
+	ids := make([]int, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.ID
+	}
+	return ids
+}
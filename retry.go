@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// backoffDelay computes the exponential backoff delay before job's next
+// retry, given the attempt it just made, with a bit of jitter to avoid
+// retry storms.
+func backoffDelay(job Job) time.Duration {
+	delay := float64(job.BackoffInitial) * math.Pow(job.BackoffFactor, float64(job.Attempt-1))
+	if max := float64(job.BackoffMax); delay > max {
+		delay = max
+	}
+	jittered := delay * (0.8 + 0.4*rand.Float64()) // +/-20% jitter
+	return time.Duration(jittered * float64(time.Second))
+}
+
+// deadHandler handles GET /dead, returning jobs that exhausted their retries.
+func deadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		debugLog("Unauthorized request on /dead")
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs, err := globalQueue.DeadLetters()
+	if err != nil {
+		http.Error(w, "Error fetching dead-letter queue", http.StatusInternalServerError)
+		log.Printf("Error fetching dead-letter queue: %v\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		debugLog("Error encoding dead-letter response: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func TestBackoffDelayGrowsExponentially(t *testing.T) {
+	job := Job{Attempt: 4, BackoffInitial: 1, BackoffFactor: 2, BackoffMax: 30}
+	d := backoffDelay(job)
+	base := 8.0 // 1 * 2^(4-1)
+	min, max := secondsToDuration(base*0.8), secondsToDuration(base*1.2)
+	if d < min || d > max {
+		t.Fatalf("expected delay within jittered range [%s, %s], got %s", min, max, d)
+	}
+}
+
+func TestBackoffDelayCapsAtMax(t *testing.T) {
+	job := Job{Attempt: 10, BackoffInitial: 1, BackoffFactor: 2, BackoffMax: 30}
+	d := backoffDelay(job)
+	min, max := secondsToDuration(30*0.8), secondsToDuration(30*1.2)
+	if d < min || d > max {
+		t.Fatalf("expected delay within jittered cap [%s, %s], got %s", min, max, d)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLoadPerCPU admission-controls /poll: if a worker's reported 1-minute
+// load average per CPU exceeds it, the server hands out zero jobs to that
+// worker this poll. 0 (the default) disables admission control entirely.
+// It is set in runServer from the -max-load flag.
+var maxLoadPerCPU float64
+
+// WorkerStats is what a worker reports about itself on each poll, via query
+// parameters set alongside "slots" and "worker". It is best-effort: fields
+// a worker doesn't send (e.g. an older worker binary) are left zero.
+type WorkerStats struct {
+	WorkerID        string    `json:"worker_id"`
+	Hostname        string    `json:"hostname"`
+	Version         string    `json:"version"`
+	CPUs            int       `json:"cpus"`
+	Load1           float64   `json:"load1"`
+	Load5           float64   `json:"load5"`
+	Load15          float64   `json:"load15"`
+	FreeMemoryBytes uint64    `json:"free_memory_bytes"`
+	RunningJobs     int       `json:"running_jobs"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// workerRegistry is a live, in-memory record of the most recent stats each
+// worker reported. It does not need to survive a restart: workers repopulate
+// it on their next poll.
+type workerRegistry struct {
+	sync.RWMutex
+	workers map[string]WorkerStats
+}
+
+func newWorkerRegistry() *workerRegistry {
+	return &workerRegistry{workers: make(map[string]WorkerStats)}
+}
+
+// report records the latest stats for a worker, stamping LastSeen.
+func (r *workerRegistry) report(stats WorkerStats) {
+	stats.LastSeen = time.Now()
+	r.Lock()
+	defer r.Unlock()
+	r.workers[stats.WorkerID] = stats
+}
+
+// list returns every known worker's stats, sorted by WorkerID.
+func (r *workerRegistry) list() []WorkerStats {
+	r.RLock()
+	defer r.RUnlock()
+	out := make([]WorkerStats, 0, len(r.workers))
+	for _, s := range r.workers {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].WorkerID < out[j].WorkerID })
+	return out
+}
+
+// parseWorkerStats reads the stats a worker attached to a /poll request.
+// Missing or unparseable fields are left at their zero value rather than
+// rejecting the poll, since stats reporting is best-effort.
+func parseWorkerStats(r *http.Request, workerID string) WorkerStats {
+	q := r.URL.Query()
+	cpus, _ := strconv.Atoi(q.Get("cpus"))
+	load1, _ := strconv.ParseFloat(q.Get("load1"), 64)
+	load5, _ := strconv.ParseFloat(q.Get("load5"), 64)
+	load15, _ := strconv.ParseFloat(q.Get("load15"), 64)
+	freeMem, _ := strconv.ParseUint(q.Get("freemem"), 10, 64)
+	running, _ := strconv.Atoi(q.Get("running"))
+	return WorkerStats{
+		WorkerID:        workerID,
+		Hostname:        q.Get("hostname"),
+		Version:         q.Get("version"),
+		CPUs:            cpus,
+		Load1:           load1,
+		Load5:           load5,
+		Load15:          load15,
+		FreeMemoryBytes: freeMem,
+		RunningJobs:     running,
+	}
+}
+
+// admissionSlots reduces requested down to 0 if stats reports a 1-minute
+// load average per CPU above maxLoadPerCPU, so an already-overloaded worker
+// is not handed more work. maxLoadPerCPU <= 0 disables this entirely.
+func admissionSlots(requested int, stats WorkerStats) int {
+	if maxLoadPerCPU <= 0 || stats.CPUs <= 0 {
+		return requested
+	}
+	if stats.Load1/float64(stats.CPUs) > maxLoadPerCPU {
+		debugLog("Worker %s over admission load threshold (load1=%.2f, cpus=%d); handing out 0 jobs", stats.WorkerID, stats.Load1, stats.CPUs)
+		return 0
+	}
+	return requested
+}
+
+// workersHandler handles GET /workers, returning the live registry of every
+// worker that has polled recently.
+func workersHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		debugLog("Unauthorized request on /workers")
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(globalWorkers.list()); err != nil {
+		debugLog("Error encoding workers response: %v", err)
+	}
+}
+
+// hostStatsQuery builds the query parameters a worker attaches to each
+// /poll request to report its host stats for the server's registry and
+// admission control: CPU count, 1/5/15-minute load average, free memory,
+// hostname, binary version and jobs currently running.
+func hostStatsQuery(hostname string, running int) url.Values {
+	load1, load5, load15 := readLoadAvg()
+	q := url.Values{}
+	q.Set("hostname", hostname)
+	q.Set("version", version)
+	q.Set("cpus", strconv.Itoa(runtime.NumCPU()))
+	q.Set("load1", strconv.FormatFloat(load1, 'f', 2, 64))
+	q.Set("load5", strconv.FormatFloat(load5, 'f', 2, 64))
+	q.Set("load15", strconv.FormatFloat(load15, 'f', 2, 64))
+	q.Set("freemem", strconv.FormatUint(readFreeMemoryBytes(), 10))
+	q.Set("running", strconv.Itoa(running))
+	return q
+}
+
+// readLoadAvg parses /proc/loadavg (Linux) for the 1, 5 and 15 minute load
+// averages. It returns zeros on platforms without /proc or if it can't be
+// read, since load reporting is best-effort.
+func readLoadAvg() (load1, load5, load15 float64) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return 0, 0, 0
+	}
+	load1, _ = strconv.ParseFloat(fields[0], 64)
+	load5, _ = strconv.ParseFloat(fields[1], 64)
+	load15, _ = strconv.ParseFloat(fields[2], 64)
+	return load1, load5, load15
+}
+
+// readFreeMemoryBytes parses /proc/meminfo's MemAvailable line (Linux). It
+// returns 0 on platforms without /proc or if the line can't be found.
+func readFreeMemoryBytes() uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "MemAvailable:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}